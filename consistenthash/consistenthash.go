@@ -0,0 +1,72 @@
+// Package consistenthash implements a consistent hashing ring, used by
+// the coordinator package to assign bitmap shards to peers in
+// distributed mode.
+package consistenthash
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Hash returns a hash of data; exposed so callers can swap in a
+// different hash function (tests use this to build deterministic
+// rings).
+type Hash func(data []byte) uint32
+
+// Ring maps arbitrary keys onto a set of peers, replicating each peer
+// across a number of virtual nodes on the hash circle so that load is
+// spread evenly even with a small number of peers.
+type Ring struct {
+	hash     Hash
+	replicas int
+	circle   []uint32
+	nodes    map[uint32]string
+}
+
+// New creates a Ring with the given number of virtual nodes per peer.
+// If fn is nil, crc32.ChecksumIEEE is used.
+func New(replicas int, fn Hash) *Ring {
+	if fn == nil {
+		fn = crc32.ChecksumIEEE
+	}
+	return &Ring{
+		hash:     fn,
+		replicas: replicas,
+		nodes:    make(map[uint32]string),
+	}
+}
+
+// IsEmpty reports whether the ring has no peers.
+func (r *Ring) IsEmpty() bool {
+	return len(r.circle) == 0
+}
+
+// Add places peers on the ring, each replicated across r.replicas
+// virtual nodes.
+func (r *Ring) Add(peers ...string) {
+	for _, peer := range peers {
+		for i := 0; i < r.replicas; i++ {
+			h := r.hash([]byte(strconv.Itoa(i) + peer))
+			r.circle = append(r.circle, h)
+			r.nodes[h] = peer
+		}
+	}
+	sort.Slice(r.circle, func(i, j int) bool { return r.circle[i] < r.circle[j] })
+}
+
+// Get returns the peer owning key: the first virtual node clockwise
+// from hash(key) on the circle, wrapping around to the first node if
+// hash(key) is past the last one.
+func (r *Ring) Get(key []byte) string {
+	if r.IsEmpty() {
+		return ""
+	}
+
+	h := r.hash(key)
+	idx := sort.Search(len(r.circle), func(i int) bool { return r.circle[i] >= h })
+	if idx == len(r.circle) {
+		idx = 0
+	}
+	return r.nodes[r.circle[idx]]
+}
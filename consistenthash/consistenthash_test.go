@@ -0,0 +1,70 @@
+package consistenthash
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingEmpty(t *testing.T) {
+	r := New(3, nil)
+	if !r.IsEmpty() {
+		t.Fatal("expected a fresh ring to be empty")
+	}
+	if got := r.Get([]byte("anything")); got != "" {
+		t.Fatalf("Get on an empty ring = %q, want \"\"", got)
+	}
+}
+
+func TestRingGetStable(t *testing.T) {
+	r := New(10, nil)
+	r.Add("a", "b", "c")
+
+	key := []byte("10.0.0.1")
+	want := r.Get(key)
+	for i := 0; i < 100; i++ {
+		if got := r.Get(key); got != want {
+			t.Fatalf("Get(%q) = %q on call %d, want %q (stable result for the same key)", key, got, i, want)
+		}
+	}
+}
+
+func TestRingGetReturnsAddedPeer(t *testing.T) {
+	r := New(10, nil)
+	peers := []string{"a", "b", "c"}
+	r.Add(peers...)
+
+	for i := 0; i < 1000; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		got := r.Get(key)
+		found := false
+		for _, p := range peers {
+			if got == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("Get(%q) = %q, not one of %v", key, got, peers)
+		}
+	}
+}
+
+func TestRingDistributesAcrossPeers(t *testing.T) {
+	r := New(100, nil)
+	r.Add("a", "b", "c")
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+		counts[r.Get(key)]++
+	}
+
+	if len(counts) != 3 {
+		t.Fatalf("expected all 3 peers to own some keys, got counts %v", counts)
+	}
+	for peer, n := range counts {
+		if n < 500 {
+			t.Errorf("peer %q only got %d/3000 keys, distribution looks too skewed: %v", peer, n, counts)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+// Package coordinator implements distributed mode: several instances
+// of the tool cooperatively process a file, each owning a disjoint
+// subset of the bitmap shards, and route IPs they don't own to the
+// peer that does over a small length-delimited TCP protocol.
+package coordinator
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AlekseevYegor/testCountIPs/consistenthash"
+)
+
+const (
+	// VirtualNodes is the number of virtual nodes each peer gets on
+	// the consistent-hash ring (K=100, as in the classic ring
+	// designs this mirrors).
+	VirtualNodes = 100
+
+	// FlushThreshold is the number of buffered IPs for a peer that
+	// triggers an eager flush, so a single hot peer doesn't grow its
+	// outbox unbounded between the caller's explicit Flush calls.
+	FlushThreshold = 4096
+
+	// DialRetryInterval and DialTimeout bound how long dial waits for
+	// a peer that hasn't started listening yet. Peers in this tool
+	// are expected to be launched at roughly the same time, so a
+	// slower-starting one is a brief race, not a failure.
+	DialRetryInterval = 200 * time.Millisecond
+	DialTimeout       = 30 * time.Second
+
+	// DoneTimeout bounds how long WaitPeersDone waits for every peer
+	// to finish processing its own input and flushing to us.
+	DoneTimeout = 5 * time.Minute
+
+	// doneFrameFlag and queryFrameFlag mark a frame's 4-byte header as
+	// a "done" notification or a count query rather than an IP batch:
+	// the remaining 30 bits are the length of the sender's address,
+	// which follows as the payload. A batch never approaches this
+	// size (FlushThreshold caps it at 4*FlushThreshold bytes), so
+	// neither flag can collide with a real batch length.
+	doneFrameFlag  = 1 << 31
+	queryFrameFlag = 1 << 30
+)
+
+// Coordinator owns the consistent-hash ring that assigns bitmap
+// shards to peers, buffers outgoing IPs per remote peer, and serves
+// both the IP-batch protocol and shard-count queries from peers.
+type Coordinator struct {
+	self       string
+	shardCount uint32
+	ring       *consistenthash.Ring
+	peers      []string
+
+	apply      func(ip uint32)
+	localCount func() uint64
+
+	mx     sync.Mutex
+	outbox map[string][]uint32
+	conns  map[string]*peerConn
+
+	doneMx   sync.Mutex
+	doneFrom map[string]bool
+	barrier  chan struct{}
+	closeBar sync.Once
+
+	servedMx    sync.Mutex
+	served      map[string]bool
+	servedBar   chan struct{}
+	closeSrvBar sync.Once
+}
+
+// peerConn pairs a cached outbound connection with a mutex
+// serializing every write/read exchange on it. Route is called
+// concurrently by up to MaxGoroutines chunk-processing goroutines, and
+// Flush/SumRemoteCounts (main goroutine) can run at the same time a
+// worker's eager flush is still in flight to the same peer; without
+// this, two goroutines racing sendBatch to the same peer could
+// interleave their header/payload writes on the wire and permanently
+// desync the receiver's framing.
+type peerConn struct {
+	conn net.Conn
+	mx   sync.Mutex
+}
+
+// New builds a Coordinator for this node. peers must include self.
+// apply is called for every IP this node owns, whether produced
+// locally or received from a peer; localCount returns this node's
+// current popcount over the shards it owns, for answering remote
+// count queries.
+func New(self string, peers []string, shardCount uint32, apply func(ip uint32), localCount func() uint64) *Coordinator {
+	ring := consistenthash.New(VirtualNodes, nil)
+	ring.Add(peers...)
+
+	others := make([]string, 0, len(peers))
+	for _, p := range peers {
+		if p != self {
+			others = append(others, p)
+		}
+	}
+
+	c := &Coordinator{
+		self:       self,
+		shardCount: shardCount,
+		ring:       ring,
+		peers:      others,
+		apply:      apply,
+		localCount: localCount,
+		outbox:     make(map[string][]uint32),
+		conns:      make(map[string]*peerConn),
+		doneFrom:   make(map[string]bool),
+		barrier:    make(chan struct{}),
+		served:     make(map[string]bool),
+		servedBar:  make(chan struct{}),
+	}
+	if len(c.peers) == 0 {
+		close(c.barrier)
+		close(c.servedBar)
+	}
+	return c
+}
+
+func shardKey(shard uint32) []byte {
+	key := make([]byte, 4)
+	binary.BigEndian.PutUint32(key, shard)
+	return key
+}
+
+// OwnerOf returns which peer owns the shard that ip hashes into.
+func (c *Coordinator) OwnerOf(ip uint32) string {
+	return c.ring.Get(shardKey(ip % c.shardCount))
+}
+
+// Owns reports whether this node owns the given shard index.
+func (c *Coordinator) Owns(shard uint32) bool {
+	return c.ring.Get(shardKey(shard)) == c.self
+}
+
+// Route applies ip locally if this node owns its shard, otherwise
+// buffers it for the owning peer, flushing eagerly past
+// FlushThreshold.
+func (c *Coordinator) Route(ip uint32) error {
+	owner := c.OwnerOf(ip)
+	if owner == c.self {
+		c.apply(ip)
+		return nil
+	}
+
+	c.mx.Lock()
+	c.outbox[owner] = append(c.outbox[owner], ip)
+	var batch []uint32
+	if len(c.outbox[owner]) >= FlushThreshold {
+		batch = c.outbox[owner]
+		c.outbox[owner] = nil
+	}
+	c.mx.Unlock()
+
+	if batch != nil {
+		return c.sendBatch(owner, batch)
+	}
+	return nil
+}
+
+// Flush sends any buffered IPs for every peer. Call once a chunk (or
+// the whole file) has been processed so nothing is left stranded in
+// the outbox.
+func (c *Coordinator) Flush() error {
+	c.mx.Lock()
+	pending := c.outbox
+	c.outbox = make(map[string][]uint32)
+	c.mx.Unlock()
+
+	for peer, ips := range pending {
+		if len(ips) == 0 {
+			continue
+		}
+		if err := c.sendBatch(peer, ips); err != nil {
+			return fmt.Errorf("flushing to %s: %w", peer, err)
+		}
+	}
+	return nil
+}
+
+// dial returns the cached connection to peer, dialing a fresh one if
+// there isn't one. The blocking retry loop runs without c.mx held, so
+// a peer that's slow to (re)connect only stalls callers routing to
+// that same peer, not the whole coordinator.
+func (c *Coordinator) dial(peer string) (*peerConn, error) {
+	c.mx.Lock()
+	pc, ok := c.conns[peer]
+	c.mx.Unlock()
+	if ok {
+		return pc, nil
+	}
+
+	deadline := time.Now().Add(DialTimeout)
+	var conn net.Conn
+	var err error
+	for {
+		conn, err = net.Dial("tcp", peer)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(DialRetryInterval)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.mx.Lock()
+	if existing, ok := c.conns[peer]; ok {
+		c.mx.Unlock()
+		conn.Close()
+		return existing, nil
+	}
+	pc = &peerConn{conn: conn}
+	c.conns[peer] = pc
+	c.mx.Unlock()
+	return pc, nil
+}
+
+// evict drops pc from the connection cache and closes it, so the next
+// dial for peer opens a fresh connection instead of reusing one a
+// write/read has already proven broken.
+func (c *Coordinator) evict(peer string, pc *peerConn) {
+	c.mx.Lock()
+	if cur, ok := c.conns[peer]; ok && cur == pc {
+		delete(c.conns, peer)
+	}
+	c.mx.Unlock()
+	pc.conn.Close()
+}
+
+// sendBatch writes a length-delimited frame of packed big-endian
+// uint32 IPs to peer. The write is serialized against any other
+// traffic to the same peer so the header and payload can never be
+// interleaved with another goroutine's frame. On a write error the
+// connection is evicted so it isn't reused once it's known broken;
+// the batch itself is not retried, so the caller must treat the
+// error as fatal to the run rather than silently dropping it.
+func (c *Coordinator) sendBatch(peer string, ips []uint32) error {
+	pc, err := c.dial(peer)
+	if err != nil {
+		return err
+	}
+
+	payload := make([]byte, 4*len(ips))
+	for i, ip := range ips {
+		binary.BigEndian.PutUint32(payload[i*4:], ip)
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+	if _, err := pc.conn.Write(header); err != nil {
+		c.evict(peer, pc)
+		return err
+	}
+	if _, err := pc.conn.Write(payload); err != nil {
+		c.evict(peer, pc)
+		return err
+	}
+	return nil
+}
+
+// SignalDone tells every peer that this node has finished processing
+// its input and flushed everything it owes them. It writes over the
+// same cached connection (and under the same per-connection lock) as
+// sendBatch, so TCP ordering guarantees the done frame arrives after
+// every batch this node will ever send that peer.
+//
+// It signals every peer it can reach before returning, rather than
+// aborting on the first failure: a peer left without our done frame
+// would otherwise sit in WaitPeersDone until DoneTimeout instead of
+// failing fast, even though the rest of the mesh is healthy.
+func (c *Coordinator) SignalDone() error {
+	var firstErr error
+	for _, peer := range c.peers {
+		if err := c.signalDoneTo(peer); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (c *Coordinator) signalDoneTo(peer string) error {
+	pc, err := c.dial(peer)
+	if err != nil {
+		return fmt.Errorf("signaling done to %s: %w", peer, err)
+	}
+
+	addr := []byte(c.self)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, doneFrameFlag|uint32(len(addr)))
+
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+	if _, err := pc.conn.Write(header); err != nil {
+		c.evict(peer, pc)
+		return fmt.Errorf("signaling done to %s: %w", peer, err)
+	}
+	if _, err := pc.conn.Write(addr); err != nil {
+		c.evict(peer, pc)
+		return fmt.Errorf("signaling done to %s: %w", peer, err)
+	}
+	return nil
+}
+
+// WaitPeersDone blocks until every peer has signaled done, or returns
+// an error once DoneTimeout elapses first. Call it after Flush and
+// SignalDone and before reading the local shard count or summing
+// remote ones: until every peer is done, IPs they own us may still be
+// in flight, and our own idea of what we own may be incomplete.
+func (c *Coordinator) WaitPeersDone() error {
+	select {
+	case <-c.barrier:
+		return nil
+	case <-time.After(DoneTimeout):
+		return fmt.Errorf("timed out after %s waiting for peers to finish", DoneTimeout)
+	}
+}
+
+func (c *Coordinator) markPeerDone(peer string) {
+	c.doneMx.Lock()
+	c.doneFrom[peer] = true
+	allDone := len(c.doneFrom) >= len(c.peers)
+	c.doneMx.Unlock()
+
+	if allDone {
+		c.closeBar.Do(func() { close(c.barrier) })
+	}
+}
+
+func (c *Coordinator) markServed(peer string) {
+	c.servedMx.Lock()
+	c.served[peer] = true
+	allServed := len(c.served) >= len(c.peers)
+	c.servedMx.Unlock()
+
+	if allServed {
+		c.closeSrvBar.Do(func() { close(c.servedBar) })
+	}
+}
+
+// WaitQueriesServed blocks until every peer has successfully queried
+// this node's count, or returns an error once DoneTimeout elapses
+// first. Call it last, after SumRemoteCounts: without it, a node that
+// finishes before a slower peer can exit and tear down its listener
+// before that peer ever gets to ask it for its count.
+func (c *Coordinator) WaitQueriesServed() error {
+	select {
+	case <-c.servedBar:
+		return nil
+	case <-time.After(DoneTimeout):
+		return fmt.Errorf("timed out after %s waiting for peers to collect our count", DoneTimeout)
+	}
+}
+
+// CountRemote asks peer for its local popcount over the shards it
+// owns, identifying itself so the peer can track which nodes have
+// collected its count, and reading back an 8-byte big-endian count in
+// response. The query and its response are serialized against any
+// other traffic to the same peer, so a concurrent sendBatch can't
+// interleave with (or steal) the response.
+func (c *Coordinator) CountRemote(peer string) (uint64, error) {
+	pc, err := c.dial(peer)
+	if err != nil {
+		return 0, err
+	}
+
+	addr := []byte(c.self)
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, queryFrameFlag|uint32(len(addr)))
+
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+
+	if _, err := pc.conn.Write(header); err != nil {
+		c.evict(peer, pc)
+		return 0, err
+	}
+	if _, err := pc.conn.Write(addr); err != nil {
+		c.evict(peer, pc)
+		return 0, err
+	}
+
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(pc.conn, resp); err != nil {
+		c.evict(peer, pc)
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(resp), nil
+}
+
+// SumRemoteCounts queries every other peer for its owned-shard
+// popcount and returns the total across all of them. Call it only
+// after WaitPeersDone: a peer's handleConn holds its own count-query
+// response until it has heard done from all of its peers, so calling
+// this first just blocks on that, but waiting here first keeps the
+// blocking visible at the call site instead of buried in the peer.
+// Follow it with WaitQueriesServed before exiting, so this node
+// doesn't tear down its listener before its own peers can query it
+// back.
+func (c *Coordinator) SumRemoteCounts() (uint64, error) {
+	var total uint64
+	for _, peer := range c.peers {
+		n, err := c.CountRemote(peer)
+		if err != nil {
+			return 0, fmt.Errorf("counting %s: %w", peer, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Listen accepts connections from peers on addr, applying incoming
+// IP-batch frames locally, recording "done" notifications, and
+// answering count queries with this node's localCount once every peer
+// has signaled done.
+func (c *Coordinator) Listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go c.acceptLoop(ln)
+	return ln, nil
+}
+
+func (c *Coordinator) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go c.handleConn(conn)
+	}
+}
+
+func (c *Coordinator) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		raw := binary.BigEndian.Uint32(header)
+
+		if raw&queryFrameFlag != 0 {
+			addr := make([]byte, raw&^queryFrameFlag)
+			if _, err := io.ReadFull(conn, addr); err != nil {
+				return
+			}
+			// Don't answer until we've heard done from every peer
+			// ourselves, so our localCount reflects every IP routed
+			// to us rather than whatever's arrived so far.
+			if err := c.WaitPeersDone(); err != nil {
+				return
+			}
+			resp := make([]byte, 8)
+			binary.BigEndian.PutUint64(resp, c.localCount())
+			if _, err := conn.Write(resp); err != nil {
+				return
+			}
+			c.markServed(string(addr))
+			continue
+		}
+
+		if raw&doneFrameFlag != 0 {
+			addr := make([]byte, raw&^doneFrameFlag)
+			if _, err := io.ReadFull(conn, addr); err != nil {
+				return
+			}
+			c.markPeerDone(string(addr))
+			continue
+		}
+
+		payload := make([]byte, raw)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		for i := 0; i+4 <= len(payload); i += 4 {
+			c.apply(binary.BigEndian.Uint32(payload[i:]))
+		}
+	}
+}
+
+// Close tears down outbound connections to peers.
+func (c *Coordinator) Close() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	var firstErr error
+	for _, pc := range c.conns {
+		if err := pc.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
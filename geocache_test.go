@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestGeoCacheGetMiss(t *testing.T) {
+	c := newGeoCache(2)
+	if _, _, ok := c.get(1); ok {
+		t.Fatal("get on an empty cache returned ok = true")
+	}
+}
+
+func TestGeoCacheGetHit(t *testing.T) {
+	c := newGeoCache(2)
+	c.put(1, "US", "AS1")
+
+	country, asn, ok := c.get(1)
+	if !ok || country != "US" || asn != "AS1" {
+		t.Fatalf("get(1) = (%q, %q, %v), want (US, AS1, true)", country, asn, ok)
+	}
+}
+
+func TestGeoCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newGeoCache(2)
+	c.put(1, "US", "AS1")
+	c.put(2, "DE", "AS2")
+	c.put(3, "FR", "AS3") // over capacity: evicts prefix 1, the least recently used
+
+	if _, _, ok := c.get(1); ok {
+		t.Fatal("prefix 1 should have been evicted, but get(1) still hit")
+	}
+	if _, _, ok := c.get(2); !ok {
+		t.Fatal("prefix 2 should still be cached")
+	}
+	if _, _, ok := c.get(3); !ok {
+		t.Fatal("prefix 3 should still be cached")
+	}
+}
+
+func TestGeoCacheGetRefreshesRecency(t *testing.T) {
+	c := newGeoCache(2)
+	c.put(1, "US", "AS1")
+	c.put(2, "DE", "AS2")
+
+	// Touch prefix 1 so it's now more recently used than prefix 2.
+	if _, _, ok := c.get(1); !ok {
+		t.Fatal("get(1) should hit")
+	}
+
+	c.put(3, "FR", "AS3") // over capacity: should evict 2, not 1
+
+	if _, _, ok := c.get(2); ok {
+		t.Fatal("prefix 2 should have been evicted after prefix 1 was touched")
+	}
+	if _, _, ok := c.get(1); !ok {
+		t.Fatal("prefix 1 should still be cached after being touched")
+	}
+}
+
+func TestGeoCachePutUpdatesExisting(t *testing.T) {
+	c := newGeoCache(2)
+	c.put(1, "US", "AS1")
+	c.put(1, "US", "AS2")
+
+	_, asn, ok := c.get(1)
+	if !ok || asn != "AS2" {
+		t.Fatalf("get(1).asn = %q, want AS2 after updating an existing entry", asn)
+	}
+}
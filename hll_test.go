@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestHLLEstimateWithinStdError(t *testing.T) {
+	h := newHLL()
+
+	const n = 100000
+	for i := 0; i < n; i++ {
+		ip := net.ParseIP(fmt.Sprintf("2001:db8::%x:%x", i>>16, i&0xFFFF))
+		h.add(ip)
+	}
+
+	got := h.estimate()
+	errPct := math.Abs(got-n) / n
+	if maxErr := 3 * h.stdError(); errPct > maxErr {
+		t.Fatalf("estimate = %.0f for n = %d: relative error %.4f exceeds 3 standard errors (%.4f)", got, n, errPct, maxErr)
+	}
+}
+
+func TestHLLMergeMatchesCombinedInput(t *testing.T) {
+	a, b, combined := newHLL(), newHLL(), newHLL()
+
+	for i := 0; i < 20000; i++ {
+		ip := net.ParseIP(fmt.Sprintf("2001:db8::1:%x", i))
+		a.add(ip)
+		combined.add(ip)
+	}
+	for i := 20000; i < 40000; i++ {
+		ip := net.ParseIP(fmt.Sprintf("2001:db8::2:%x", i))
+		b.add(ip)
+		combined.add(ip)
+	}
+
+	a.Merge(b)
+
+	if got, want := a.estimate(), combined.estimate(); math.Abs(got-want) > 1 {
+		t.Fatalf("merged estimate = %.2f, want %.2f (estimate of the combined input)", got, want)
+	}
+}
+
+func TestHLLEmptyEstimatesZero(t *testing.T) {
+	h := newHLL()
+	if got := h.estimate(); got != 0 {
+		t.Fatalf("estimate of an empty hll = %v, want 0", got)
+	}
+}
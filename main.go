@@ -2,89 +2,503 @@ package main
 
 import (
 	"bytes"
+	"container/list"
+	"encoding/binary"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"math/bits"
 	"net"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
-	"golang.org/x/exp/mmap"
+	"github.com/RoaringBitmap/roaring"
+	"github.com/oschwald/maxminddb-golang"
+
+	"github.com/AlekseevYegor/testCountIPs/coordinator"
 )
 
 const (
 	IPv4Max       = 4294967296   // 2^32 - max count unique ip4 addresses
-	BitmapSize    = IPv4Max / 8  // size of bit slice
 	ShardCount    = 256          // 256
 	ChunkSize     = 10240 * 1024 // buffer size for reading file
 	MaxGoroutines = 10
+
+	// HLLPrecision controls the number of HyperLogLog registers
+	// (m = 2^HLLPrecision). p=14 gives m=16384, ~0.81% standard
+	// error, at ~12KB of memory.
+	HLLPrecision = 14
+	HLLRegisters = 1 << HLLPrecision
+
+	// CountryPromoteThreshold is the distinct-hit count at which a
+	// country's (or ASN's) counter is promoted from a plain map to a
+	// full bitmap. Most countries in a typical log see far fewer
+	// unique IPs than a 2MB bitmap is built for, so the map is kept
+	// around as long as it's cheaper.
+	CountryPromoteThreshold = 4096
+
+	// GeoCacheSize is the number of /24 prefixes kept in the GeoIP
+	// lookup LRU. Adjacent IPs from the same region of the file tend
+	// to share a /24, so caching by prefix amortizes MMDB lookups.
+	GeoCacheSize = 4096
 )
 
+// bitmap tracks unique IPv4 addresses as one Roaring bitmap per
+// shard, so memory scales with how many addresses are actually seen
+// rather than with the full 2^32 address space.
 type bitmap struct {
 	shards []shard
 }
 type shard struct {
+	mx   sync.Mutex
+	bits *roaring.Bitmap
+}
+
+// hll is a HyperLogLog cardinality estimator used for IPv6 addresses,
+// for which an exact bitmap would require a 2^128-bit array. Callers
+// that want to estimate across goroutines should accumulate into a
+// local hll (via addHash, unlocked) and combine with Merge once per
+// chunk to avoid contending on a shared mutex.
+type hll struct {
+	mx        sync.Mutex
+	registers []uint8
+}
+
+func newHLL() *hll {
+	return &hll{registers: make([]uint8, HLLRegisters)}
+}
+
+// add hashes ip (expected to be a 16-byte IPv6 address) and folds it
+// into the registers without locking. It is safe only when h is not
+// shared with other goroutines; use Merge to combine local instances.
+func (h *hll) add(ip net.IP) {
+	hasher := fnv.New64a()
+	hasher.Write(ip)
+	h.addHash(hasher.Sum64())
+}
+
+func (h *hll) addHash(hash uint64) {
+	// FNV-1a diffuses structured inputs poorly: IPv6 addresses from
+	// the same /64 share a long common prefix, so their raw hashes
+	// barely differ in the high bits used below as the register
+	// index, and the estimate collapses onto a handful of buckets.
+	// Avalanche it (splitmix64's finalizer) before extracting bits.
+	hash = mix64(hash)
+
+	j := hash >> (64 - HLLPrecision)
+	rest := hash<<HLLPrecision | (1 << (HLLPrecision - 1))
+	rho := uint8(bits.LeadingZeros64(rest) + 1)
+	if rho > h.registers[j] {
+		h.registers[j] = rho
+	}
+}
+
+// mix64 is splitmix64's finalizer, used to avalanche a hash before
+// splitting it into a register index and a leading-zero count.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Merge takes the elementwise max of other's registers into h, under
+// h's mutex, so multiple per-goroutine HLLs can be combined into one
+// shared estimator at the end of each chunk.
+func (h *hll) Merge(other *hll) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// estimate returns the HyperLogLog cardinality estimate, with small-
+// and large-range corrections applied.
+func (h *hll) estimate() float64 {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+
+	m := float64(HLLRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / math.Pow(2, float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+
+	switch {
+	case estimate <= 2.5*m && zeros > 0:
+		return m * math.Log(m/float64(zeros))
+	case estimate > math.Pow(2, 32)/30:
+		return -math.Pow(2, 32) * math.Log(1-estimate/math.Pow(2, 32))
+	default:
+		return estimate
+	}
+}
+
+// stdError returns the standard error of the estimate, ~1.04/sqrt(m).
+func (h *hll) stdError() float64 {
+	return 1.04 / math.Sqrt(HLLRegisters)
+}
+
+// ipCounter tracks the set of unique IPs seen for a single key (a
+// country or an ASN). It starts as a plain map, which is cheap for
+// the common case of a key with few hits, and promotes itself to a
+// full bitmap once it crosses CountryPromoteThreshold distinct IPs.
+type ipCounter struct {
 	mx    sync.Mutex
-	slice []byte
+	small map[uint32]struct{}
+	full  *bitmap
 }
 
-func main() {
-	var start = time.Now()
-	var bm = newBitmap()
+func newIPCounter() *ipCounter {
+	return &ipCounter{small: make(map[uint32]struct{})}
+}
+
+func (c *ipCounter) add(ip uint32) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
 
-	filePath := "ip_addresses" //
+	if c.full != nil {
+		c.full.setBit(ip)
+		return
+	}
 
-	reader, err := mmap.Open(filePath)
+	c.small[ip] = struct{}{}
+	if len(c.small) >= CountryPromoteThreshold {
+		c.full = newBitmap()
+		for existing := range c.small {
+			c.full.setBit(existing)
+		}
+		c.small = nil
+	}
+}
+
+func (c *ipCounter) count() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if c.full != nil {
+		return c.full.countBits()
+	}
+	return len(c.small)
+}
+
+// keyedCount is one row of a sorted breakdown report.
+type keyedCount struct {
+	key   string
+	count int
+}
+
+// geoTracker keeps a per-country and, when the MMDB provides it, a
+// per-ASN breakdown of unique IPs, allocating each key's ipCounter
+// lazily on first hit.
+type geoTracker struct {
+	mx        sync.Mutex
+	byCountry map[string]*ipCounter
+	byASN     map[string]*ipCounter
+}
+
+func newGeoTracker() *geoTracker {
+	return &geoTracker{
+		byCountry: make(map[string]*ipCounter),
+		byASN:     make(map[string]*ipCounter),
+	}
+}
+
+func (g *geoTracker) addCountry(country string, ip uint32) {
+	g.counter(g.byCountry, country).add(ip)
+}
+
+func (g *geoTracker) addASN(asn string, ip uint32) {
+	g.counter(g.byASN, asn).add(ip)
+}
+
+func (g *geoTracker) counter(by map[string]*ipCounter, key string) *ipCounter {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	c, ok := by[key]
+	if !ok {
+		c = newIPCounter()
+		by[key] = c
+	}
+	return c
+}
+
+func (g *geoTracker) report(by map[string]*ipCounter) []keyedCount {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	rows := make([]keyedCount, 0, len(by))
+	for key, c := range by {
+		rows = append(rows, keyedCount{key: key, count: c.count()})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].count > rows[j].count })
+	return rows
+}
+
+// geoCacheEntry is one LRU entry, mapping a /24 prefix to the GeoIP
+// resolution result for that prefix.
+type geoCacheEntry struct {
+	prefix  uint32
+	country string
+	asn     string
+}
+
+// geoCache is a small LRU over /24 prefixes, used to avoid repeating
+// an MMDB lookup for every IP when a file has long runs of addresses
+// from the same network.
+type geoCache struct {
+	mx       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[uint32]*list.Element
+}
+
+func newGeoCache(capacity int) *geoCache {
+	return &geoCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[uint32]*list.Element, capacity),
+	}
+}
+
+func (c *geoCache) get(prefix uint32) (country, asn string, ok bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	elem, ok := c.items[prefix]
+	if !ok {
+		return "", "", false
+	}
+	c.ll.MoveToFront(elem)
+	entry := elem.Value.(*geoCacheEntry)
+	return entry.country, entry.asn, true
+}
+
+func (c *geoCache) put(prefix uint32, country, asn string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if elem, ok := c.items[prefix]; ok {
+		c.ll.MoveToFront(elem)
+		elem.Value.(*geoCacheEntry).country = country
+		elem.Value.(*geoCacheEntry).asn = asn
+		return
+	}
+
+	elem := c.ll.PushFront(&geoCacheEntry{prefix: prefix, country: country, asn: asn})
+	c.items[prefix] = elem
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*geoCacheEntry).prefix)
+		}
+	}
+}
+
+// geoRecord mirrors the subset of MaxMind GeoIP2/GeoLite2 fields we
+// care about. Country and ASN data normally live in separate MMDB
+// files; decoding both from whichever file is loaded means a record
+// simply comes back zero-valued for fields the file doesn't have.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// geoResolver resolves IPv4 addresses to a country code and, when
+// available, an ASN, backed by an MMDB reader and a /24 LRU cache.
+type geoResolver struct {
+	db    *maxminddb.Reader
+	cache *geoCache
+}
+
+func openGeoResolver(path string) (*geoResolver, error) {
+	db, err := maxminddb.Open(path)
 	if err != nil {
-		log.Fatalf("Error opening file: %v", err)
+		return nil, fmt.Errorf("opening GeoIP database: %w", err)
 	}
-	defer reader.Close()
-	fileSize := reader.Len()
-	fmt.Printf("File size: %d bytes\n", fileSize)
+	return &geoResolver{db: db, cache: newGeoCache(GeoCacheSize)}, nil
+}
 
-	var (
-		buffer         = make([]byte, ChunkSize)
-		processedBytes int
-		leftover       []byte
-		wg             sync.WaitGroup
-		sem            = make(chan struct{}, MaxGoroutines)
-	)
+func (r *geoResolver) close() error {
+	return r.db.Close()
+}
+
+func (r *geoResolver) resolve(ip net.IP) (country, asn string) {
+	prefix := ipv4ToUint32(ip) >> 8
+
+	if country, asn, ok := r.cache.get(prefix); ok {
+		return country, asn
+	}
+
+	var record geoRecord
+	if err := r.db.Lookup(ip, &record); err != nil {
+		r.cache.put(prefix, "??", "")
+		return "??", ""
+	}
+
+	country = record.Country.ISOCode
+	if country == "" {
+		country = "??"
+	}
+	if record.ASN != 0 {
+		asn = fmt.Sprintf("AS%d", record.ASN)
+	}
+
+	r.cache.put(prefix, country, asn)
+	return country, asn
+}
 
-	for offset := 0; offset < fileSize; offset += ChunkSize {
-		readSize := ChunkSize
-		if offset+ChunkSize > fileSize {
-			readSize = fileSize - offset
+func main() {
+	geoipPath := flag.String("geoip", "", "path to a MaxMind GeoIP2/GeoLite2 mmdb file; when set, reports a per-country (and per-ASN, if present in the database) unique IP breakdown")
+	self := flag.String("self", "", "this node's host:port, as listed in -peers (enables distributed mode)")
+	peers := flag.String("peers", "", "comma-separated host:port list of all cooperating nodes, including self (enables distributed mode)")
+	listenAddr := flag.String("listen", "", "address to accept peer connections on (defaults to -self)")
+	stream := flag.Bool("stream", false, "read length-delimited IP frames from stdin (or -stream-addr, if set) instead of the ip_addresses file")
+	streamAddr := flag.String("stream-addr", "", "host:port to accept streamed IP frames on over TCP; with -stream and no -stream-addr, frames are read from stdin")
+	flag.Parse()
+
+	var start = time.Now()
+	var hl = newHLL()
+	var geo *geoTracker
+	var resolver *geoResolver
+	var coord *coordinator.Coordinator
+
+	if *geoipPath != "" {
+		var err error
+		resolver, err = openGeoResolver(*geoipPath)
+		if err != nil {
+			log.Fatalf("Error opening GeoIP database: %v", err)
 		}
+		defer resolver.close()
+		geo = newGeoTracker()
+	}
 
-		_, err := reader.ReadAt(buffer[:readSize], int64(offset))
-		if err != nil && err != io.EOF {
-			log.Fatalf("Error reading file with mmap: %v", err)
+	var bm *bitmap
+	if *peers == "" {
+		bm = newBitmap()
+	} else {
+		if *self == "" {
+			log.Fatalf("-self is required when -peers is set")
+		}
+		addr := *listenAddr
+		if addr == "" {
+			addr = *self
 		}
 
-		chunk := append(leftover, buffer[:readSize]...)
+		// apply/localCount close over bm itself rather than its value,
+		// so they see the shard-aware bitmap built just below.
+		coord = coordinator.New(*self, strings.Split(*peers, ","), ShardCount,
+			func(ip uint32) { bm.setBit(ip) },
+			func() uint64 { return uint64(bm.countBits()) },
+		)
+		bm = newBitmapWithOwnership(coord.Owns)
 
-		rows := bytes.Split(chunk, []byte("\n"))
+		if _, err := coord.Listen(addr); err != nil {
+			log.Fatalf("Error listening for peers on %s: %v", addr, err)
+		}
+		defer coord.Close()
+	}
 
-		leftover = rows[len(rows)-1]
+	var src Source
+	switch {
+	case *stream && *streamAddr != "":
+		tcpSrc, err := NewTCPFramedSource(*streamAddr)
+		if err != nil {
+			log.Fatalf("Error listening for streamed IPs on %s: %v", *streamAddr, err)
+		}
+		defer tcpSrc.Close()
+		src = tcpSrc
+	case *stream:
+		src = NewStdinSource()
+	default:
+		filePath := "ip_addresses" //
+		mmapSrc, err := NewMmapSource(filePath)
+		if err != nil {
+			log.Fatalf("Error opening file: %v", err)
+		}
+		defer mmapSrc.Close()
+		fmt.Printf("File size: %d bytes\n", mmapSrc.fileSize)
+		src = mmapSrc
+	}
 
-		wg.Add(1)
-		sem <- struct{}{}
-		go processChunk(sem, &wg, bm, rows[:len(rows)-1])
+	counter := NewCounter(bm, hl, resolver, geo, coord)
 
-		processedBytes += readSize
-		fmt.Printf("Processed: %.2f%%\n", float64(processedBytes)/float64(fileSize)*100)
+	if err := ingest(src, counter); err != nil {
+		log.Fatalf("Error ingesting IPs: %v", err)
 	}
 
-	wg.Add(1)
-	sem <- struct{}{}
-	go processChunk(sem, &wg, bm, [][]byte{leftover})
-
-	wg.Wait()
+	if coord != nil {
+		if err := coord.Flush(); err != nil {
+			log.Fatalf("Error flushing to peers: %v", err)
+		}
+		if err := coord.SignalDone(); err != nil {
+			log.Fatalf("Error signaling done to peers: %v", err)
+		}
+		if err := coord.WaitPeersDone(); err != nil {
+			log.Fatalf("Error waiting for peers to finish: %v", err)
+		}
+	}
 
+	// Only safe to count now: in distributed mode, every IP peers
+	// routed to us is guaranteed to have arrived by the time they
+	// signal done over the same (ordered) connection they sent it on.
 	uniqueCount := bm.countBits()
-	println("Number of unique IP addresses: ", uniqueCount)
+	if coord != nil {
+		remote, err := coord.SumRemoteCounts()
+		if err != nil {
+			log.Fatalf("Error collecting remote shard counts: %v", err)
+		}
+		uniqueCount += int(remote)
+
+		// Don't let this node exit (and tear down its listener) before
+		// every peer has had a chance to query it back, or a fast node
+		// finishing first would strand a slower peer's own count.
+		if err := coord.WaitQueriesServed(); err != nil {
+			log.Fatalf("Error waiting for peers to collect our count: %v", err)
+		}
+	}
+	println("Number of unique IPv4 addresses: ", uniqueCount)
+
+	v6Estimate := hl.estimate()
+	fmt.Printf("Estimated unique IPv6 addresses: %.0f (standard error: %.2f%%)\n", v6Estimate, hl.stdError()*100)
+
+	if geo != nil {
+		fmt.Println("Unique IPv4 addresses by country:")
+		for _, row := range geo.report(geo.byCountry) {
+			fmt.Printf("  %s: %d\n", row.key, row.count)
+		}
+
+		if asnRows := geo.report(geo.byASN); len(asnRows) > 0 {
+			fmt.Println("Unique IPv4 addresses by ASN:")
+			for _, row := range asnRows {
+				fmt.Printf("  %s: %d\n", row.key, row.count)
+			}
+		}
+	}
 
 	var memStats runtime.MemStats
 	runtime.ReadMemStats(&memStats)
@@ -98,74 +512,246 @@ func main() {
 	println("Processing time: ", time.Now().Sub(start).String())
 }
 
-func processChunk(sem chan struct{}, wg *sync.WaitGroup, bm *bitmap, rows [][]byte) {
-	defer wg.Done()
-	defer func() { <-sem }()
+// ingest drains src, handing each Payload off to a bounded pool of
+// MaxGoroutines workers that fold it into counter. This is the same
+// back-pressured worker-pool shape the original mmap-only loop used,
+// now shared by every Source. Once any worker reports a fatal error
+// (e.g. a dropped peer connection), ingest stops reading further
+// payloads from src rather than racing to the end of the file: the
+// run is already doomed, so there's no point spawning more doomed
+// sends to a broken peer.
+func ingest(src Source, counter *Counter) error {
+	var (
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, MaxGoroutines)
+		errMx    sync.Mutex
+		firstErr error
+	)
 
-	for _, row := range rows {
+	for {
+		errMx.Lock()
+		stop := firstErr != nil
+		errMx.Unlock()
+		if stop {
+			break
+		}
+
+		payload, err := src.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(payload.Data) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p Payload) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var err error
+			if p.Binary {
+				err = counter.ProcessBinaryChunk(p.Data)
+			} else {
+				err = counter.ProcessChunk(p.Data)
+			}
+			if err != nil {
+				errMx.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMx.Unlock()
+			}
+		}(payload)
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// Counter holds all of the accumulators a chunk of IPs is folded
+// into: the exact IPv4 bitmap, the IPv6 HyperLogLog estimator, and
+// the optional GeoIP breakdown and distributed-mode router. A Source
+// feeds it Payloads; ProcessChunk/ProcessBinaryChunk do the same work
+// processChunk used to do directly against the mmap loop.
+type Counter struct {
+	bm       *bitmap
+	hl       *hll
+	resolver *geoResolver
+	geo      *geoTracker
+	coord    *coordinator.Coordinator
+}
+
+func NewCounter(bm *bitmap, hl *hll, resolver *geoResolver, geo *geoTracker, coord *coordinator.Coordinator) *Counter {
+	return &Counter{bm: bm, hl: hl, resolver: resolver, geo: geo, coord: coord}
+}
+
+// ProcessChunk parses newline-separated ASCII IPs out of data,
+// routing each IPv4 address into a local Roaring bitmap (or a remote
+// peer, in distributed mode) and each IPv6 address into a local HLL.
+// Both accumulators are merged into the Counter's shared state once,
+// at the end, rather than taking a shard lock per IP. It stops and
+// returns the first routing error it hits (e.g. a dropped peer
+// connection in distributed mode), since continuing would silently
+// undercount rather than surface the failure.
+func (c *Counter) ProcessChunk(data []byte) error {
+	localHLL := newHLL()
+	localBM := newLocalBitmap()
+
+	var routeErr error
+	for _, row := range bytes.Split(data, []byte("\n")) {
 		row := strings.TrimSpace(string(row))
 		if row == "" {
 			continue
 		}
 
-		ip, err := ipToUint32(row)
-		if err != nil {
+		parsedIP := net.ParseIP(row)
+		if parsedIP == nil {
 			println("Invalid IP address: ", row)
 			continue
 		}
 
-		bm.setBit(ip)
+		if v4 := parsedIP.To4(); v4 != nil {
+			if err := c.addV4(v4, localBM); err != nil {
+				routeErr = err
+				break
+			}
+			continue
+		}
+
+		localHLL.add(parsedIP.To16())
 	}
 
+	c.hl.Merge(localHLL)
+	c.bm.mergeLocal(localBM)
+	return routeErr
 }
 
-func ipToUint32(ip string) (uint32, error) {
-	parsedIP := net.ParseIP(ip)
-	if parsedIP == nil {
-		return 0, fmt.Errorf("invalid IP address: %s", ip)
+// ProcessBinaryChunk applies a packed slice of 4-byte big-endian IPv4
+// addresses, as produced by a TCPFramedSource/StdinSource binary
+// frame or by the distributed-mode wire protocol. Like ProcessChunk,
+// it stops and returns the first routing error it hits.
+func (c *Counter) ProcessBinaryChunk(data []byte) error {
+	localBM := newLocalBitmap()
+
+	var routeErr error
+	for i := 0; i+4 <= len(data); i += 4 {
+		ip := binary.BigEndian.Uint32(data[i:])
+		if err := c.addV4(ipv4FromUint32(ip), localBM); err != nil {
+			routeErr = err
+			break
+		}
 	}
-	parsedIP = parsedIP.To4()
-	if parsedIP == nil {
-		return 0, fmt.Errorf("not an IPv4 address: %s", ip)
+
+	c.bm.mergeLocal(localBM)
+	return routeErr
+}
+
+// addV4 routes ip locally or to its owning peer. A routing failure is
+// returned rather than logged and swallowed: the batch that failed to
+// send is already gone from the peer's outbox, so silently continuing
+// would let the run finish and report a confidently wrong count.
+func (c *Counter) addV4(v4 net.IP, localBM *localBitmap) error {
+	ip := ipv4ToUint32(v4)
+	if c.coord != nil {
+		if err := c.coord.Route(ip); err != nil {
+			return fmt.Errorf("routing IP to peer: %w", err)
+		}
+	} else {
+		localBM.add(ip)
 	}
-	return uint32(parsedIP[0])<<24 | uint32(parsedIP[1])<<16 | uint32(parsedIP[2])<<8 | uint32(parsedIP[3]), nil
+
+	if c.resolver != nil {
+		country, asn := c.resolver.resolve(v4)
+		c.geo.addCountry(country, ip)
+		if asn != "" {
+			c.geo.addASN(asn, ip)
+		}
+	}
+	return nil
 }
 
-func (b *bitmap) setBit(index uint32) {
-	shardIndex := index % ShardCount
-	localShard := &b.shards[shardIndex]
+func ipv4ToUint32(ip net.IP) uint32 {
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
 
-	byteIndex := (index / 8) % (BitmapSize / ShardCount)
-	bitOffset := index % 8
+func ipv4FromUint32(ip uint32) net.IP {
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).To4()
+}
 
-	localShard.mx.Lock()
-	defer localShard.mx.Unlock()
-	localShard.slice[byteIndex] |= 1 << bitOffset
+func (b *bitmap) setBit(index uint32) {
+	s := &b.shards[index%ShardCount]
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.bits.Add(index)
 }
 
-func (b *bitmap) countBits() int {
-	count := 0
-	for _, shd := range b.shards {
-		for _, byteVal := range shd.slice {
-			count += bitsInByte(byteVal)
+// mergeLocal ORs a per-goroutine localBitmap into b, taking each
+// touched shard's mutex once rather than once per IP.
+func (b *bitmap) mergeLocal(l *localBitmap) {
+	for i, rb := range l.shards {
+		if rb == nil {
+			continue
 		}
+		s := &b.shards[i]
+		s.mx.Lock()
+		s.bits.Or(rb)
+		s.mx.Unlock()
 	}
-	return count
 }
 
-func bitsInByte(b byte) int {
+func (b *bitmap) countBits() int {
 	count := 0
-	for b > 0 {
-		count += int(b & 1)
-		b >>= 1
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.mx.Lock()
+		if s.bits != nil {
+			count += int(s.bits.GetCardinality())
+		}
+		s.mx.Unlock()
 	}
 	return count
 }
 
 func newBitmap() *bitmap {
+	return newBitmapWithOwnership(func(uint32) bool { return true })
+}
+
+// newBitmapWithOwnership allocates a Roaring bitmap only for shards
+// for which owns returns true. In distributed mode each node only
+// ever sets bits in shards it owns (setBit calls for the rest are
+// routed to the owning peer instead), so the unowned shards can be
+// left nil and never touched.
+func newBitmapWithOwnership(owns func(shardIndex uint32) bool) *bitmap {
 	shards := make([]shard, ShardCount)
 	for i := range shards {
-		shards[i].slice = make([]byte, BitmapSize/ShardCount)
+		if owns(uint32(i)) {
+			shards[i].bits = roaring.New()
+		}
 	}
 	return &bitmap{shards: shards}
 }
+
+// localBitmap accumulates IPs for one goroutine's chunk of work,
+// sharded the same way as bitmap but without any locking, so it can
+// be merged into the shared bitmap with one lock acquisition per
+// touched shard instead of one per IP.
+type localBitmap struct {
+	shards [ShardCount]*roaring.Bitmap
+}
+
+func newLocalBitmap() *localBitmap {
+	return &localBitmap{}
+}
+
+func (l *localBitmap) add(ip uint32) {
+	idx := ip % ShardCount
+	if l.shards[idx] == nil {
+		l.shards[idx] = roaring.New()
+	}
+	l.shards[idx].Add(ip)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+
+	"golang.org/x/exp/mmap"
+)
+
+// binaryFrameFlag marks a frame's 4-byte length header as carrying a
+// packed binary payload (4-byte big-endian IPs) rather than ASCII
+// text; the remaining 31 bits are the payload length in bytes.
+const binaryFrameFlag = 1 << 31
+
+// Payload is one unit of work handed from a Source to the ingest
+// loop: either ASCII text (newline-separated IPs) or, when Binary is
+// set, a packed slice of 4-byte big-endian IPv4 addresses.
+type Payload struct {
+	Data   []byte
+	Binary bool
+}
+
+// Source produces a stream of Payloads to feed into a Counter. Next
+// returns io.EOF once the source is exhausted.
+type Source interface {
+	Next() (Payload, error)
+}
+
+// MmapSource reads a file via mmap in ChunkSize blocks, reassembling
+// complete lines across block boundaries the same way the original
+// single-file loop did, and reports read progress as it goes.
+type MmapSource struct {
+	reader   *mmap.ReaderAt
+	fileSize int
+	offset   int
+	buffer   []byte
+	leftover []byte
+	flushed  bool
+}
+
+func NewMmapSource(path string) (*MmapSource, error) {
+	reader, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MmapSource{
+		reader:   reader,
+		fileSize: reader.Len(),
+		buffer:   make([]byte, ChunkSize),
+	}, nil
+}
+
+func (s *MmapSource) Next() (Payload, error) {
+	if s.offset >= s.fileSize {
+		if s.flushed {
+			return Payload{}, io.EOF
+		}
+		s.flushed = true
+		return Payload{Data: s.leftover}, nil
+	}
+
+	readSize := ChunkSize
+	if s.offset+ChunkSize > s.fileSize {
+		readSize = s.fileSize - s.offset
+	}
+
+	if _, err := s.reader.ReadAt(s.buffer[:readSize], int64(s.offset)); err != nil && err != io.EOF {
+		return Payload{}, err
+	}
+
+	chunk := append(s.leftover, s.buffer[:readSize]...)
+	rows := bytes.Split(chunk, []byte("\n"))
+	s.leftover = rows[len(rows)-1]
+
+	s.offset += readSize
+	println("Processed: ", s.offset*100/s.fileSize, "%")
+
+	return Payload{Data: bytes.Join(rows[:len(rows)-1], []byte("\n"))}, nil
+}
+
+func (s *MmapSource) Close() error {
+	return s.reader.Close()
+}
+
+// readFrame reads one length-delimited frame: a 4-byte big-endian
+// header (top bit set for a binary payload, remaining 31 bits the
+// payload length) followed by that many bytes of payload.
+func readFrame(r io.Reader) (Payload, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return Payload{}, err
+	}
+
+	raw := binary.BigEndian.Uint32(header)
+	isBinary := raw&binaryFrameFlag != 0
+	length := raw &^ binaryFrameFlag
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Payload{}, err
+	}
+
+	return Payload{Data: data, Binary: isBinary}, nil
+}
+
+// StdinSource reads length-delimited frames from os.Stdin, letting
+// log shippers (or anything else) pipe IPs into the tool in-process.
+type StdinSource struct {
+	r io.Reader
+}
+
+func NewStdinSource() *StdinSource {
+	return &StdinSource{r: os.Stdin}
+}
+
+func (s *StdinSource) Next() (Payload, error) {
+	return readFrame(s.r)
+}
+
+// TCPFramedSource accepts connections on addr and reads the same
+// length-delimited frame format as StdinSource from each one,
+// multiplexing them onto a single bounded channel of Payloads so the
+// tool can act as an aggregation daemon for multiple log shippers.
+type TCPFramedSource struct {
+	ln       net.Listener
+	payloads chan Payload
+}
+
+func NewTCPFramedSource(addr string) (*TCPFramedSource, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &TCPFramedSource{
+		ln:       ln,
+		payloads: make(chan Payload, MaxGoroutines),
+	}
+	go s.acceptLoop()
+	return s, nil
+}
+
+func (s *TCPFramedSource) acceptLoop() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *TCPFramedSource) handleConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		payload, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+		s.payloads <- payload
+	}
+}
+
+func (s *TCPFramedSource) Next() (Payload, error) {
+	payload, ok := <-s.payloads
+	if !ok {
+		return Payload{}, io.EOF
+	}
+	return payload, nil
+}
+
+func (s *TCPFramedSource) Close() error {
+	return s.ln.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestReadFrameASCII(t *testing.T) {
+	text := []byte("1.2.3.4\n5.6.7.8")
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(text)))
+	r := bytes.NewReader(append(header, text...))
+
+	got, err := readFrame(r)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if got.Binary {
+		t.Fatal("Binary = true, want false for an ASCII frame")
+	}
+	if !bytes.Equal(got.Data, text) {
+		t.Fatalf("Data = %q, want %q", got.Data, text)
+	}
+}
+
+func TestReadFrameBinary(t *testing.T) {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:], 0x01020304)
+	binary.BigEndian.PutUint32(payload[4:], 0x0A0B0C0D)
+	binary.BigEndian.PutUint32(payload[8:], 0xFFFFFFFF)
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, binaryFrameFlag|uint32(len(payload)))
+	r := bytes.NewReader(append(header, payload...))
+
+	got, err := readFrame(r)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if !got.Binary {
+		t.Fatal("Binary = false, want true for a binary frame")
+	}
+	if !bytes.Equal(got.Data, payload) {
+		t.Fatalf("Data = %x, want %x", got.Data, payload)
+	}
+}
+
+func TestReadFrameEmpty(t *testing.T) {
+	header := make([]byte, 4)
+	r := bytes.NewReader(header)
+
+	got, err := readFrame(r)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if got.Binary || len(got.Data) != 0 {
+		t.Fatalf("readFrame of a zero-length frame = %+v, want empty non-binary payload", got)
+	}
+}
+
+func TestReadFrameShortRead(t *testing.T) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, 10)
+	r := bytes.NewReader(append(header, []byte("short")...))
+
+	if _, err := readFrame(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("readFrame on a truncated payload = %v, want io.ErrUnexpectedEOF", err)
+	}
+}